@@ -1,28 +1,46 @@
 package chatserver
 
 import (
+	"errors"
 	"time"
 )
 
+// Returned by Client.SendMessage when the client's buffer is full, meaning
+// it's not draining messages fast enough and should be evicted.
+var ErrBufferFull = errors.New("chatserver: client buffer full")
+
 // Represents the client connected to a chat server.
 type Client struct {
 	topic string
 	connectedAt time.Time
 	messages chan *Message
+	lastEventId int
+	transport Transport
 }
 
-// Creates new client instance.
-func NewClient(topic string) *Client {
+// Creates new client instance. lastEventId is the id the client last saw
+// before (re)connecting, or -1 if it did not provide one. transport is the
+// wire-level connection (SSE, websocket, ...) this client will be written to.
+// bufferSize bounds how many unsent messages are queued for it.
+func NewClient(topic string, lastEventId int, transport Transport, bufferSize int) *Client {
 	return &Client{
 		topic,
 		time.Now(),
-		make(chan *Message),
+		make(chan *Message, bufferSize),
+		lastEventId,
+		transport,
 	}
 }
 
-// Sends message to client.
-func (c *Client) SendMessage(message *Message) {
-	c.messages <- message
+// Sends message to client, without blocking. Returns ErrBufferFull if the
+// client isn't draining its buffer fast enough to take it.
+func (c *Client) SendMessage(message *Message) error {
+	select {
+	case c.messages <- message:
+		return nil
+	default:
+		return ErrBufferFull
+	}
 }
 
 // Returns the topic that this client is subscribed to.
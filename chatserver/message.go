@@ -1,7 +1,9 @@
 package chatserver
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -22,6 +24,13 @@ func TimeoutMessage(id string, data string) *Message {
 	return NewMessage(id, data, "timeout")
 }
 
+// Creates expired message instance, signalling to a reconnecting client that
+// the history it requested via Last-Event-ID has already fallen out of the
+// topic's ring buffer.
+func ExpiredMessage() *Message {
+	return NewMessage("", "", "expired")
+}
+
 // Creates new message instance.
 func NewMessage(id string, data string, event string) *Message {
 	return &Message{
@@ -31,8 +40,16 @@ func NewMessage(id string, data string, event string) *Message {
 	}
 }
 
-// Returns message as string.
-func (m *Message) Serialize() string {
+// jsonMessage mirrors a Message's wire representation for JSON encodings:
+// the /json HTTP suffix and the websocket transport both use it.
+type jsonMessage struct {
+	ID    string `json:"id,omitempty"`
+	Event string `json:"event,omitempty"`
+	Data  string `json:"data,omitempty"`
+}
+
+// Returns message as an SSE event frame (id:/event:/data: lines).
+func (m *Message) SerializeSSE() string {
 	var str strings.Builder
 
 	if len(m.id) > 0 {
@@ -51,4 +68,37 @@ func (m *Message) Serialize() string {
 	str.WriteString("\n")
 
 	return str.String()
+}
+
+// Returns message as a newline-delimited JSON object.
+func (m *Message) SerializeJSON() string {
+	encoded, err := json.Marshal(jsonMessage{m.id, m.event, m.data})
+	if err != nil {
+		return "{}\n"
+	}
+
+	return string(encoded) + "\n"
+}
+
+// Returns message as its raw payload followed by a newline, with no framing
+// metadata. Callers subscribing in raw mode are expected to drop control
+// events (timeouts, expiry and overflow notices) and messages that have no
+// data rather than serialize them.
+func (m *Message) SerializeRaw() string {
+	return m.data + "\n"
+}
+
+// Returns the numeric sequence number encoded in the message id, and whether
+// it could be parsed. IDs are assigned by Server.nextMessageId (from a
+// Store's sequence, or else Server.generateMessageId) and are monotonically
+// increasing, which makes them directly comparable.
+func (m *Message) numericId() (int, bool) {
+	n, err := strconv.Atoi(m.id)
+	return n, err == nil
+}
+
+// Sets the message's id after the fact, once Server has assigned it (e.g.
+// from a Store's sequence number).
+func (m *Message) setId(id string) {
+	m.id = id
 }
\ No newline at end of file
@@ -1,6 +1,7 @@
 package chatserver
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -11,62 +12,190 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
-const connectionTimeoutSec = 30
+const (
+	defaultConnectionTimeout    = 30 * time.Second
+	defaultMaxConnectionTimeout = 5 * time.Minute
+	defaultTopicHistorySize     = 256
+	defaultClientBufferSize     = 64
+	defaultTopicReapInterval    = 30 * time.Second
+)
 
 type MessageRequest struct {
 	topic       string
 	message     string
 }
 
+// A request to set a topic's TTL override, submitted by handleTopicConfig
+// and applied on the server's event loop goroutine alongside every other
+// topic lifecycle decision.
+type TopicConfigRequest struct {
+	topic string
+	ttl   time.Duration
+}
+
 type Server struct {
-	topics             map[string]*Topic
-	clientConnected    chan *Client
-	clientDisconnected chan *Client
-	messageReceived    chan *MessageRequest
-	serverShutdown     chan bool
-	lastMessageId      int
-	logger             *log.Logger
-	mtx                sync.RWMutex
+	topics               map[string]*Topic
+	clientConnected      chan *Client
+	clientDisconnected   chan *Client
+	messageReceived      chan *MessageRequest
+	topicConfigRequested chan *TopicConfigRequest
+	serverShutdown       chan bool
+	lastMessageId        int
+	topicHistorySize     int
+	clientBufferSize     int
+	connectionTimeout    time.Duration
+	maxConnectionTimeout time.Duration
+	heartbeatInterval    time.Duration
+	defaultTopicTTL      time.Duration
+	store                Store
+	logger               *log.Logger
+	mtx                  sync.RWMutex
+}
+
+// Configures a Server. Pass options to NewServer.
+type ServerOption func(*Server)
+
+// Sets how many recent messages each topic retains for Last-Event-ID replay.
+func WithTopicHistorySize(size int) ServerOption {
+	return func(s *Server) {
+		s.topicHistorySize = size
+	}
+}
+
+// Sets how many unsent messages are queued per client before it's
+// considered a slow consumer and evicted.
+func WithClientBufferSize(size int) ServerOption {
+	return func(s *Server) {
+		s.clientBufferSize = size
+	}
+}
+
+// Sets the persistence layer topics and messages are durably appended to.
+// Without it, the server keeps messages in memory only.
+func WithStore(store Store) ServerOption {
+	return func(s *Server) {
+		s.store = store
+	}
+}
+
+// Sets the default idle connection timeout, overridable per-request by a
+// ?timeout= query parameter up to WithMaxConnectionTimeout.
+func WithConnectionTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.connectionTimeout = timeout
+	}
+}
+
+// Bounds how far a ?timeout= query parameter can raise a request's
+// connection timeout above the default.
+func WithMaxConnectionTimeout(max time.Duration) ServerOption {
+	return func(s *Server) {
+		s.maxConnectionTimeout = max
+	}
+}
+
+// Enables periodic SSE comment heartbeats (": ping\n\n"), sent every interval
+// on SSE-encoded connections whether or not messages are flowing, so proxies
+// and load balancers see traffic and don't drop the stream early.
+// Zero (the default) disables heartbeats.
+func WithHeartbeat(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.heartbeatInterval = interval
+	}
+}
+
+// Sets the default idle TTL new topics are created with: once a topic has no
+// subscribers and has seen no activity for longer than this, the reaper
+// destroys it. Zero (the default) means topics never expire on their own.
+// Overridable per-topic via POST /infocenter/{topic}/config.
+func WithDefaultTopicTTL(ttl time.Duration) ServerOption {
+	return func(s *Server) {
+		s.defaultTopicTTL = ttl
+	}
 }
 
 // Creates new server instance.
-func NewServer() *Server {
+func NewServer(opts ...ServerOption) *Server {
 	s := &Server{
 		make(map[string]*Topic),
 		make(chan *Client),
 		make(chan *Client),
 		make(chan *MessageRequest),
+		make(chan *TopicConfigRequest),
 		make(chan bool),
 		0,
+		defaultTopicHistorySize,
+		defaultClientBufferSize,
+		defaultConnectionTimeout,
+		defaultMaxConnectionTimeout,
+		0,
+		0,
+		nil,
 		log.New(os.Stdout, "[chatserver] ", log.LstdFlags),
 		sync.RWMutex{},
 	}
 
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.restoreTopics()
+
 	go s.listen()
 	go s.processMessages()
 
 	return s
 }
 
+// Recreates topic metadata (but not subscribers) for every topic already
+// known to the store, if one is configured, so posts and Last-Event-ID
+// replay work immediately after a restart.
+func (s *Server) restoreTopics() {
+	if s.store == nil {
+		return
+	}
+
+	for _, name := range s.store.Topics() {
+		if _, exists := s.getTopic(name); !exists {
+			s.createTopic(name)
+		}
+	}
+}
+
 // Shuts down the server.
 func (s *Server) Shutdown() {
 	s.serverShutdown <- true
 }
 
+// Upgrades GET requests to /infocenter/{topic}/ws into websocket connections.
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(request *http.Request) bool { return true },
+}
+
 // Serves HTTP requests.
 func (s *Server) ServeHTTP(response http.ResponseWriter, request *http.Request) {
 	if request.Method == "GET" {
-		s.handleGetMessages(response, request)
+		if strings.HasSuffix(request.URL.Path, "/ws") {
+			s.handleWebSocket(response, request)
+		} else {
+			s.handleGetMessages(response, request)
+		}
 	} else if request.Method == "POST" {
-		s.handlePostMessage(response, request)
+		if strings.HasSuffix(request.URL.Path, "/config") {
+			s.handleTopicConfig(response, request)
+		} else {
+			s.handlePostMessage(response, request)
+		}
 	} else {
 		response.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
-// Handles GET messages request.
+// Handles GET messages request, in the SSE, JSON, or raw encoding.
 func (s *Server) handleGetMessages(response http.ResponseWriter, request *http.Request) {
 	flusher, ok := response.(http.Flusher)
 	if !ok {
@@ -74,44 +203,63 @@ func (s *Server) handleGetMessages(response http.ResponseWriter, request *http.R
 		return
 	}
 
-	topicName := strings.TrimPrefix(request.URL.Path, "/infocenter/")
+	topicName, enc := parseEncoding(request)
 	if topicName == "" {
 		http.Error(response, "Missing topic name request parameter.", http.StatusBadRequest)
 		return
 	}
 
-	client := NewClient(topicName)
-	s.clientConnected <- client
-
-	timer := time.NewTimer(connectionTimeoutSec * time.Second)
-	defer timer.Stop()
-
-	requestFinished := request.Context().Done()
-
 	response.Header().Set("Cache-Control", "no-cache")
-	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Content-Type", contentTypeFor(enc))
 	response.Header().Set("Connection", "keep-alive")
 	response.Header().Set("Access-Control-Allow-Origin", "*")
 
 	response.WriteHeader(http.StatusOK)
 	flusher.Flush()
 
+	transport := newSSETransport(response, flusher, request.Context(), enc)
+	client := NewClient(topicName, parseLastEventId(request), transport, s.clientBufferSize)
+	s.clientConnected <- client
+
+	timeout := parseConnectionTimeout(request, s.connectionTimeout, s.maxConnectionTimeout)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// Heartbeats only make sense as SSE comments; json/raw subscribers rely
+	// on the connection timeout instead.
+	var heartbeatC <-chan time.Time
+	if enc == encodingSSE && s.heartbeatInterval > 0 {
+		heartbeat := time.NewTicker(s.heartbeatInterval)
+		defer heartbeat.Stop()
+		heartbeatC = heartbeat.C
+	}
+
+	requestFinished := request.Context().Done()
+
 	defer func() {
+		_ = transport.Close()
 		s.clientDisconnected <- client
 		for range client.messages {}
 	}()
 
 	for {
 		select {
-		case message := <-client.messages:
-			_, _ = fmt.Fprintf(response, message.Serialize())
+		case message, ok := <-client.messages:
+			if !ok {
+				return
+			}
+			if err := transport.Write(message); err != nil {
+				return
+			}
+		case <-heartbeatC:
+			if _, err := fmt.Fprint(response, ": ping\n\n"); err != nil {
+				return
+			}
 			flusher.Flush()
 		case <-timer.C:
 			connectedTimeInSeconds := s.getClientConnectedTime(client)
 			s.logger.Printf("client connected for %d seconds, disconnecting.", connectedTimeInSeconds)
-			message := TimeoutMessage("", fmt.Sprintf("%ds", connectedTimeInSeconds))
-			_, _ = fmt.Fprintf(response, message.Serialize())
-			flusher.Flush()
+			_ = transport.Write(TimeoutMessage("", fmt.Sprintf("%ds", connectedTimeInSeconds)))
 			return
 		case <-requestFinished:
 			return
@@ -119,6 +267,123 @@ func (s *Server) handleGetMessages(response http.ResponseWriter, request *http.R
 	}
 }
 
+// Handles GET messages request over a websocket connection at
+// /infocenter/{topic}/ws, as an alternative to SSE for the same topic.
+func (s *Server) handleWebSocket(response http.ResponseWriter, request *http.Request) {
+	topicName := strings.TrimSuffix(strings.TrimPrefix(request.URL.Path, "/infocenter/"), "/ws")
+	if topicName == "" {
+		http.Error(response, "Missing topic name request parameter.", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(response, request, nil)
+	if err != nil {
+		s.logger.Printf("websocket upgrade for topic '%s' failed: %v", topicName, err)
+		return
+	}
+
+	transport := newWSTransport(conn)
+	client := NewClient(topicName, parseLastEventId(request), transport, s.clientBufferSize)
+	s.clientConnected <- client
+
+	defer func() {
+		_ = transport.Close()
+		s.clientDisconnected <- client
+		for range client.messages {}
+	}()
+
+	for {
+		select {
+		case message, ok := <-client.messages:
+			if !ok {
+				return
+			}
+			if err := transport.Write(message); err != nil {
+				return
+			}
+		case <-transport.Context().Done():
+			return
+		}
+	}
+}
+
+// Parses the topic name and desired response encoding from a GET request.
+// The /json and /raw path suffixes take priority; failing that, the Accept
+// header is used to negotiate a default.
+func parseEncoding(request *http.Request) (string, encoding) {
+	topicName := strings.TrimPrefix(request.URL.Path, "/infocenter/")
+
+	if trimmed := strings.TrimSuffix(topicName, "/json"); trimmed != topicName {
+		return trimmed, encodingJSON
+	}
+
+	if trimmed := strings.TrimSuffix(topicName, "/raw"); trimmed != topicName {
+		return trimmed, encodingRaw
+	}
+
+	switch request.Header.Get("Accept") {
+	case "application/json":
+		return topicName, encodingJSON
+	case "text/plain":
+		return topicName, encodingRaw
+	default:
+		return topicName, encodingSSE
+	}
+}
+
+// Returns the Content-Type header to send for a given response encoding.
+func contentTypeFor(enc encoding) string {
+	switch enc {
+	case encodingJSON:
+		return "application/x-ndjson"
+	case encodingRaw:
+		return "text/plain"
+	default:
+		return "text/event-stream"
+	}
+}
+
+// Parses a per-request ?timeout= query parameter (in seconds), falling back
+// to def if absent or invalid, and bounding it to max.
+func parseConnectionTimeout(request *http.Request, def time.Duration, max time.Duration) time.Duration {
+	raw := request.URL.Query().Get("timeout")
+	if raw == "" {
+		return def
+	}
+
+	seconds, err := strconv.Atoi(raw)
+	if err != nil || seconds <= 0 {
+		return def
+	}
+
+	if timeout := time.Duration(seconds) * time.Second; timeout <= max {
+		return timeout
+	}
+
+	return max
+}
+
+// Parses the Last-Event-ID request header, falling back to a lastEventId
+// query parameter, for clients resuming a stream. Returns -1 if neither is
+// present or parseable.
+func parseLastEventId(request *http.Request) int {
+	raw := request.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = request.URL.Query().Get("lastEventId")
+	}
+
+	if raw == "" {
+		return -1
+	}
+
+	id, err := strconv.Atoi(raw)
+	if err != nil {
+		return -1
+	}
+
+	return id
+}
+
 // Handles POST message request.
 func (s *Server) handlePostMessage(response http.ResponseWriter, request *http.Request) {
 	topicName := strings.TrimPrefix(request.URL.Path, "/infocenter/")
@@ -145,27 +410,80 @@ func (s *Server) handlePostMessage(response http.ResponseWriter, request *http.R
 	response.WriteHeader(http.StatusNoContent)
 }
 
+// Handles POST /infocenter/{topic}/config, setting a per-topic idle TTL
+// override (e.g. {"ttl":"5m"}) on top of the server's default.
+func (s *Server) handleTopicConfig(response http.ResponseWriter, request *http.Request) {
+	topicName := strings.TrimSuffix(strings.TrimPrefix(request.URL.Path, "/infocenter/"), "/config")
+	if topicName == "" {
+		http.Error(response, "Missing topic name request parameter.", http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		TTL string `json:"ttl"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		http.Error(response, "Failed to parse request body.", http.StatusBadRequest)
+		return
+	}
+
+	ttl, err := time.ParseDuration(body.TTL)
+	if err != nil {
+		http.Error(response, "Invalid ttl duration.", http.StatusBadRequest)
+		return
+	}
+
+	s.topicConfigRequested <- &TopicConfigRequest{topicName, ttl}
+
+	response.WriteHeader(http.StatusNoContent)
+}
+
 // Send message to all clients subscribed to a topic.
 func (s *Server) sendMessageToTopic(topicName string, message string) {
-	if topic, exists := s.getTopic(topicName); exists {
-		nextMessageId := s.generateMessageId()
+	topic, exists := s.getTopic(topicName)
+	if !exists {
+		s.logger.Printf("message not sent because topic '%s' has no subscriptions.", topicName)
+		return
+	}
 
-		topic.SendMessage(TextMessage(strconv.Itoa(nextMessageId), message))
+	msg := TextMessage("", message)
 
-		s.logger.Printf(
-			"sent message '%s' with id %s to topic '%s'",
-			message,
-			strconv.Itoa(nextMessageId),
-			topicName,
-		)
-	} else {
-		s.logger.Printf("message not sent because topic '%s' has no subscriptions.", topicName)
+	idStr, err := s.nextMessageId(topicName, msg)
+	if err != nil {
+		s.logger.Printf("failed to persist message for topic '%s': %v", topicName, err)
+		return
 	}
+	msg.setId(idStr)
+
+	topic.SendMessage(msg)
+
+	s.logger.Printf("sent message '%s' with id %s to topic '%s'", message, idStr, topicName)
+}
+
+// Assigns the next id for a message on topicName. When a Store is
+// configured, the id is the log sequence number Append assigns, which
+// makes ids durable across restarts; otherwise it falls back to the
+// in-memory counter.
+func (s *Server) nextMessageId(topicName string, msg *Message) (string, error) {
+	if s.store == nil {
+		return strconv.Itoa(s.generateMessageId()), nil
+	}
+
+	id, err := s.store.Append(topicName, msg)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatUint(id, 10), nil
 }
 
 // Creates new topic on the server.
 func (s *Server) createTopic(name string) *Topic {
-	topic := NewTopic(name)
+	topic := NewTopic(name, s.topicHistorySize)
+	topic.store = s.store
+	topic.logger = s.logger
+	topic.disconnect = s.clientDisconnected
+	topic.ttl = s.defaultTopicTTL
 
 	s.mtx.Lock()
 	s.topics[topic.name] = topic
@@ -205,10 +523,10 @@ func (s *Server) destroyTopics() {
 
 // Generates new message id.
 func (s *Server) generateMessageId() int {
-	s.mtx.RLock()
+	s.mtx.Lock()
 	s.lastMessageId++
 	newId := s.lastMessageId
-	s.mtx.RUnlock()
+	s.mtx.Unlock()
 
 	return newId
 }
@@ -217,6 +535,9 @@ func (s *Server) generateMessageId() int {
 func (s *Server) listen() {
 	s.logger.Print("server started.")
 
+	reapTicker := time.NewTicker(defaultTopicReapInterval)
+	defer reapTicker.Stop()
+
 	for {
 		select {
 
@@ -226,6 +547,12 @@ func (s *Server) listen() {
 		case c := <-s.clientDisconnected:
 			s.onClientDisconnected(c)
 
+		case req := <-s.topicConfigRequested:
+			s.onTopicConfig(req)
+
+		case <-reapTicker.C:
+			s.reapExpiredTopics()
+
 		case <-s.serverShutdown:
 			s.onServerShutdown()
 			return
@@ -233,6 +560,24 @@ func (s *Server) listen() {
 	}
 }
 
+// Destroys any topic that has had no subscribers and no activity for longer
+// than its TTL.
+func (s *Server) reapExpiredTopics() {
+	s.mtx.RLock()
+	topics := make([]*Topic, 0, len(s.topics))
+	for _, topic := range s.topics {
+		topics = append(topics, topic)
+	}
+	s.mtx.RUnlock()
+
+	for _, topic := range topics {
+		if topic.IsExpired() {
+			s.logger.Printf("topic '%s' exceeded its TTL with no subscribers, reaping.", topic.name)
+			s.destroyTopic(topic)
+		}
+	}
+}
+
 func (s *Server) processMessages() {
 	for {
 		select {
@@ -261,14 +606,30 @@ func (s *Server) onClientDisconnected(c *Client) {
 		s.logger.Printf("client unsubscribed from topic '%s'.", topic.name)
 
 		if !topic.HasSubscribers() {
-			s.logger.Printf("topic '%s' has no clients subscribed, destroying.", topic.name)
-			s.destroyTopic(topic)
+			if topic.HasTTL() {
+				s.logger.Printf("topic '%s' has no clients subscribed, leaving it for the reaper.", topic.name)
+			} else {
+				s.logger.Printf("topic '%s' has no clients subscribed, destroying.", topic.name)
+				s.destroyTopic(topic)
+			}
 		}
 	} else {
 		s.logger.Printf("Topic does not exist")
 	}
 }
 
+// Handles a topic config request, creating the topic if it doesn't exist
+// yet.
+func (s *Server) onTopicConfig(req *TopicConfigRequest) {
+	topic, exists := s.getTopic(req.topic)
+	if !exists {
+		topic = s.createTopic(req.topic)
+	}
+	topic.SetTTL(req.ttl)
+
+	s.logger.Printf("topic '%s' ttl set to %s.", req.topic, req.ttl)
+}
+
 func (s *Server) getClientConnectedTime(c *Client) int {
 	duration := c.GetConnectedTime()
 	return int(math.RoundToEven(duration.Seconds()))
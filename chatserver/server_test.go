@@ -0,0 +1,138 @@
+package chatserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseEncoding(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		accept     string
+		wantTopic  string
+		wantEncode encoding
+	}{
+		{
+			name:       "path suffix /json takes priority over Accept",
+			path:       "/infocenter/news/json",
+			accept:     "text/plain",
+			wantTopic:  "news",
+			wantEncode: encodingJSON,
+		},
+		{
+			name:       "path suffix /raw takes priority over Accept",
+			path:       "/infocenter/news/raw",
+			accept:     "application/json",
+			wantTopic:  "news",
+			wantEncode: encodingRaw,
+		},
+		{
+			name:       "Accept: application/json selects JSON",
+			path:       "/infocenter/news",
+			accept:     "application/json",
+			wantTopic:  "news",
+			wantEncode: encodingJSON,
+		},
+		{
+			name:       "Accept: text/plain selects raw",
+			path:       "/infocenter/news",
+			accept:     "text/plain",
+			wantTopic:  "news",
+			wantEncode: encodingRaw,
+		},
+		{
+			name:       "no Accept header defaults to SSE",
+			path:       "/infocenter/news",
+			wantTopic:  "news",
+			wantEncode: encodingSSE,
+		},
+		{
+			name:       "unrecognized Accept header defaults to SSE",
+			path:       "/infocenter/news",
+			accept:     "application/xml",
+			wantTopic:  "news",
+			wantEncode: encodingSSE,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.accept != "" {
+				request.Header.Set("Accept", tt.accept)
+			}
+
+			topicName, enc := parseEncoding(request)
+			if topicName != tt.wantTopic || enc != tt.wantEncode {
+				t.Fatalf("got (%q, %v), want (%q, %v)", topicName, enc, tt.wantTopic, tt.wantEncode)
+			}
+		})
+	}
+}
+
+func TestContentTypeFor(t *testing.T) {
+	tests := []struct {
+		enc  encoding
+		want string
+	}{
+		{encodingJSON, "application/x-ndjson"},
+		{encodingRaw, "text/plain"},
+		{encodingSSE, "text/event-stream"},
+	}
+
+	for _, tt := range tests {
+		if got := contentTypeFor(tt.enc); got != tt.want {
+			t.Errorf("contentTypeFor(%v) = %q, want %q", tt.enc, got, tt.want)
+		}
+	}
+}
+
+func TestParseLastEventId(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		want   int
+	}{
+		{
+			name:   "Last-Event-ID header",
+			header: "42",
+			want:   42,
+		},
+		{
+			name:  "lastEventId query parameter fallback",
+			query: "?lastEventId=7",
+			want:  7,
+		},
+		{
+			name:   "header takes priority over query parameter",
+			header: "42",
+			query:  "?lastEventId=7",
+			want:   42,
+		},
+		{
+			name: "absent defaults to -1",
+			want: -1,
+		},
+		{
+			name:   "unparseable header defaults to -1",
+			header: "not-a-number",
+			want:   -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/infocenter/news"+tt.query, nil)
+			if tt.header != "" {
+				request.Header.Set("Last-Event-ID", tt.header)
+			}
+
+			if got := parseLastEventId(request); got != tt.want {
+				t.Fatalf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
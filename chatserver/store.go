@@ -0,0 +1,185 @@
+package chatserver
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/tidwall/wal"
+)
+
+// Store persists topics and their messages so they survive a process
+// restart. walStore (see NewWalStore) is the implementation this package
+// provides.
+type Store interface {
+	// Appends msg to topic's log and returns the sequence number it was
+	// assigned. That sequence number becomes the message's id.
+	Append(topic string, msg *Message) (uint64, error)
+	// Calls fn, in order, for every message in topic with fromID <= id,
+	// bounded above by toID (0 means unbounded), until fn returns false or
+	// the range is exhausted.
+	Range(topic string, fromID uint64, toID uint64, fn func(*Message) bool) error
+	// Returns the sequence number most recently assigned by Append for
+	// topic, or 0 if nothing has been appended to it yet.
+	LastID(topic string) (uint64, error)
+	// Returns the names of all topics that have ever been appended to.
+	Topics() []string
+}
+
+// Persists each topic's messages to its own write-ahead log on disk, one
+// segment directory per topic under dir, using tidwall/wal (as msgbus does).
+type walStore struct {
+	dir  string
+	mtx  sync.Mutex
+	logs map[string]*wal.Log
+}
+
+// Opens a Store that persists topics and messages to a write-ahead log on
+// disk under dir (one segment directory per topic).
+func NewWalStore(dir string) (Store, error) {
+	return newWalStore(dir)
+}
+
+// Opens (creating if necessary) a walStore rooted at dir.
+func newWalStore(dir string) (*walStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &walStore{
+		dir,
+		sync.Mutex{},
+		make(map[string]*wal.Log),
+	}, nil
+}
+
+func (s *walStore) Append(topic string, msg *Message) (uint64, error) {
+	log, err := s.logFor(topic)
+	if err != nil {
+		return 0, err
+	}
+
+	encoded, err := json.Marshal(jsonMessage{Event: msg.event, Data: msg.data})
+	if err != nil {
+		return 0, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	index, err := log.LastIndex()
+	if err != nil {
+		return 0, err
+	}
+	index++
+
+	if err := log.Write(index, encoded); err != nil {
+		return 0, err
+	}
+
+	return index, nil
+}
+
+func (s *walStore) Range(topic string, fromID uint64, toID uint64, fn func(*Message) bool) error {
+	log, err := s.logFor(topic)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	firstIndex, err := log.FirstIndex()
+	if err == nil && fromID > firstIndex {
+		firstIndex = fromID
+	}
+	lastIndex, lastErr := log.LastIndex()
+	s.mtx.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+	if lastIndex == 0 {
+		return nil
+	}
+	if toID > 0 && toID < lastIndex {
+		lastIndex = toID
+	}
+
+	for index := firstIndex; index <= lastIndex; index++ {
+		s.mtx.Lock()
+		data, err := log.Read(index)
+		s.mtx.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		var jm jsonMessage
+		if err := json.Unmarshal(data, &jm); err != nil {
+			return err
+		}
+
+		if !fn(NewMessage(strconv.FormatUint(index, 10), jm.Data, jm.Event)) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (s *walStore) LastID(topic string) (uint64, error) {
+	log, err := s.logFor(topic)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return log.LastIndex()
+}
+
+func (s *walStore) Topics() []string {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil
+	}
+
+	topics := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		// Range and LastID open, and so create, a topic's log as well; only
+		// count it once something has been appended to it.
+		if lastID, err := s.LastID(entry.Name()); err == nil && lastID > 0 {
+			topics = append(topics, entry.Name())
+		}
+	}
+
+	return topics
+}
+
+// Returns the topic's log, opening it on first use.
+func (s *walStore) logFor(topic string) (*wal.Log, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if log, exists := s.logs[topic]; exists {
+		return log, nil
+	}
+
+	log, err := wal.Open(filepath.Join(s.dir, topic), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logs[topic] = log
+
+	return log, nil
+}
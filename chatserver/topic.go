@@ -1,53 +1,250 @@
 package chatserver
 
 import (
+	"log"
 	"sync"
+	"time"
 )
 
 // Represents topic that clients can subscribe to.
 type Topic struct {
-	name        string
-	clients     map[*Client]bool
-	mtx         sync.RWMutex
+	name         string
+	clients      map[*Client]bool
+	history      []*Message
+	historySize  int
+	store        Store
+	logger       *log.Logger
+	disconnect   chan<- *Client
+	mtx          sync.RWMutex
+	ttl          time.Duration
+	lastActivity time.Time
 }
 
-// Creates instance of a new topic.
-func NewTopic(name string) *Topic {
+// Creates instance of a new topic. historySize bounds how many recent
+// messages are kept for Last-Event-ID replay.
+func NewTopic(name string, historySize int) *Topic {
 	return &Topic{
 		name,
 		make(map[*Client]bool),
+		make([]*Message, 0, historySize),
+		historySize,
+		nil,
+		nil,
+		nil,
 		sync.RWMutex{},
+		0,
+		time.Now(),
 	}
 }
 
-// Subscribes client to a topic.
+// Subscribes client to a topic, replaying any backlog it missed. Falling
+// back to the durable store happens on its own goroutine, off the caller's
+// (typically the server's single event-loop goroutine), so a slow disk read
+// there doesn't stall every other topic's connects, disconnects, and config
+// requests along with it; see replayFromStore.
 func (t *Topic) Subscribe(client *Client) {
 	t.mtx.Lock()
 	t.clients[client] = true
+	t.touch()
+	replayed := t.replayFromHistory(client)
+
+	var upperBound uint64
+	if !replayed && t.store != nil {
+		upperBound, _ = t.store.LastID(t.name)
+	}
 	t.mtx.Unlock()
+
+	if !replayed {
+		go t.replayFromStore(client, upperBound)
+	}
 }
 
-// Unsubscribes client from a topic.
+// Unsubscribes client from a topic. Safe to call more than once for the same
+// client (e.g. a handler's own cleanup racing an eviction) — only the first
+// call closes its message channel.
 func (t *Topic) Unsubscribe(client *Client) {
 	t.mtx.Lock()
+	_, subscribed := t.clients[client]
 	t.clients[client] = false
 	delete(t.clients, client)
+	t.touch()
 	t.mtx.Unlock()
 
-	client.Unsubscribe()
+	if subscribed {
+		client.Unsubscribe()
+	}
 }
 
-// Sends a message to all clients subscribed to this topic.
+// Sends a message to all clients subscribed to this topic, recording it in
+// the topic's history ring buffer first. Delivery happens synchronously,
+// under t.mtx, same as Unsubscribe: Client.SendMessage is a non-blocking
+// channel send, so one slow or dead connection can't hold up the rest, and
+// serializing it against Unsubscribe this way is what keeps a delivery from
+// ever racing the close of that client's channel. Holding the lock for the
+// whole broadcast also keeps each client's delivery order consistent with
+// the order SendMessage was called in. Clients found to be slow consumers
+// are disconnected after the lock is released; see disconnectEvicted.
 func (t *Topic) SendMessage(message *Message) {
-	t.mtx.RLock()
+	t.mtx.Lock()
+
+	t.appendHistory(message)
+	t.touch()
 
+	var evicted []*Client
 	for c, open := range t.clients {
-		if open {
-			c.SendMessage(message)
+		if open && t.deliver(c, message) {
+			evicted = append(evicted, c)
 		}
 	}
 
-	t.mtx.RUnlock()
+	t.mtx.Unlock()
+
+	for _, c := range evicted {
+		t.disconnectEvicted(c)
+	}
+}
+
+// Records activity on the topic, resetting its idle timer. Caller must hold
+// t.mtx for writing.
+func (t *Topic) touch() {
+	t.lastActivity = time.Now()
+}
+
+// Sets the topic's idle TTL, overriding the server's default for this topic.
+func (t *Topic) SetTTL(ttl time.Duration) {
+	t.mtx.Lock()
+	t.ttl = ttl
+	t.mtx.Unlock()
+}
+
+// Reports whether the topic has a non-zero idle TTL, meaning an
+// unsubscribe that leaves it with no subscribers shouldn't destroy it right
+// away — the reaper is responsible for expiring it once IsExpired is true.
+func (t *Topic) HasTTL() bool {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	return t.ttl > 0
+}
+
+// Reports whether the topic has had no subscribers and no activity for
+// longer than its TTL. A zero TTL means the topic never expires.
+func (t *Topic) IsExpired() bool {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	return t.ttl > 0 && len(t.clients) == 0 && time.Since(t.lastActivity) > t.ttl
+}
+
+// Delivers message to client without blocking. If its buffer is already
+// full, it also tries to queue a final overflow event without blocking; that
+// event is dropped when the buffer still has no room for it. Reports whether
+// the client should be
+// evicted; the caller is then responsible for calling disconnectEvicted
+// once t.mtx is released. Caller must hold t.mtx.
+func (t *Topic) deliver(client *Client, message *Message) bool {
+	if client.SendMessage(message) == nil {
+		return false
+	}
+
+	if t.logger != nil {
+		t.logger.Printf("client on topic '%s' not keeping up, evicting.", t.name)
+	}
+
+	select {
+	case client.messages <- NewMessage("", "", "overflow"):
+	default:
+	}
+
+	return true
+}
+
+// Hands an evicted client to the server to be unsubscribed and disconnected.
+// Must not be called with t.mtx held: disconnect is drained by the server's
+// single event-loop goroutine, which may itself be blocked waiting on this
+// same lock (e.g. inside Unsubscribe, handling an earlier disconnect) —
+// blocking this send while holding the lock would deadlock against that.
+func (t *Topic) disconnectEvicted(client *Client) {
+	if t.disconnect != nil {
+		t.disconnect <- client
+	}
+}
+
+// Appends message to the bounded history ring buffer, dropping the oldest
+// entry once historySize is exceeded. Caller must hold t.mtx for writing.
+func (t *Topic) appendHistory(message *Message) {
+	t.history = append(t.history, message)
+
+	if len(t.history) > t.historySize {
+		t.history = t.history[len(t.history)-t.historySize:]
+	}
+}
+
+// Replays the in-memory ring buffer's entries newer than client's last-seen
+// id, if the ring buffer covers what was requested. Reports whether replay
+// was fully handled this way; if not, the caller must fall back to
+// replayFromStore. Caller must hold t.mtx.
+func (t *Topic) replayFromHistory(client *Client) bool {
+	if client.lastEventId < 0 {
+		return true
+	}
+
+	if len(t.history) == 0 {
+		return false
+	}
+
+	oldestId, ok := t.history[0].numericId()
+	if !ok || client.lastEventId < oldestId {
+		return false
+	}
+
+	for _, message := range t.history {
+		if id, ok := message.numericId(); ok && id > client.lastEventId {
+			if client.SendMessage(message) != nil {
+				break
+			}
+		}
+	}
+
+	return true
+}
+
+// Falls back to the durable store for a client whose requested history has
+// aged out of the in-memory ring buffer, either because it was trimmed or
+// because the process just restarted; tells the client its history has
+// expired if no store is configured or the store lookup fails. upperBound
+// is the store's last assigned id as of the moment client was registered
+// with the topic (see Subscribe), so the range replayed here stops exactly
+// where live delivery via SendMessage picks up — without it, a message
+// appended between registration and this call would land in both. Intended
+// to be run on its own goroutine (Subscribe does this), since Range may
+// need to read an entire WAL segment from disk; each send is guarded by
+// t.mtx so it can't race a concurrent Unsubscribe closing client.messages.
+func (t *Topic) replayFromStore(client *Client, upperBound uint64) {
+	if t.store != nil {
+		if err := t.store.Range(t.name, uint64(client.lastEventId+1), upperBound, func(message *Message) bool {
+			return t.sendIfSubscribed(client, message)
+		}); err == nil {
+			return
+		}
+	}
+
+	t.sendIfSubscribed(client, ExpiredMessage())
+}
+
+// Sends message to client if it's still subscribed to the topic, guarding
+// against a concurrent Unsubscribe closing client.messages. Reports whether
+// the client is still subscribed and ready for a next message (false once
+// it isn't, or its buffer is full), which Range also treats as "stop".
+func (t *Topic) sendIfSubscribed(client *Client, message *Message) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if _, subscribed := t.clients[client]; !subscribed {
+		return false
+	}
+
+	return client.SendMessage(message) == nil
 }
 
 // Returns the number of subscriptions to a topic.
@@ -69,4 +266,4 @@ func (t *Topic) Destroy() {
 	for client := range t.clients {
 		t.Unsubscribe(client)
 	}
-}
\ No newline at end of file
+}
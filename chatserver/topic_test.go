@@ -0,0 +1,265 @@
+package chatserver
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStore is a minimal in-memory Store test double.
+type fakeStore struct {
+	mtx      sync.Mutex
+	messages map[string][]*Message
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{messages: make(map[string][]*Message)}
+}
+
+func (s *fakeStore) Append(topic string, msg *Message) (uint64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	id := uint64(len(s.messages[topic]) + 1)
+	msg.setId(strconv.FormatUint(id, 10))
+	s.messages[topic] = append(s.messages[topic], msg)
+
+	return id, nil
+}
+
+func (s *fakeStore) Range(topic string, fromID uint64, toID uint64, fn func(*Message) bool) error {
+	s.mtx.Lock()
+	messages := append([]*Message(nil), s.messages[topic]...)
+	s.mtx.Unlock()
+
+	for _, message := range messages {
+		id, _ := message.numericId()
+		if uint64(id) < fromID {
+			continue
+		}
+		if toID > 0 && uint64(id) > toID {
+			break
+		}
+		if !fn(message) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (s *fakeStore) LastID(topic string) (uint64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return uint64(len(s.messages[topic])), nil
+}
+
+func (s *fakeStore) Topics() []string {
+	return nil
+}
+
+// Receives up to n messages from client.messages, giving up once timeout
+// elapses. Subscribe's store-backed replay runs on its own goroutine (see
+// Topic.replayFromStore), so tests exercising it need to wait rather than
+// assume the messages are already queued by the time Subscribe returns.
+func collectMessages(client *Client, n int, timeout time.Duration) []*Message {
+	deadline := time.After(timeout)
+	var got []*Message
+
+	for len(got) < n {
+		select {
+		case message, ok := <-client.messages:
+			if !ok {
+				return got
+			}
+			got = append(got, message)
+		case <-deadline:
+			return got
+		}
+	}
+
+	return got
+}
+
+// Returns the numeric ids of messages, in order, skipping any that don't
+// parse as one (e.g. a control event like "expired").
+func messageIds(messages []*Message) []int {
+	var ids []int
+	for _, message := range messages {
+		if id, ok := message.numericId(); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Drains client.messages until it's closed, recording every numeric message
+// id seen, in receive order.
+func drainIds(client *Client, done chan<- []int) {
+	var ids []int
+	for message := range client.messages {
+		if id, ok := message.numericId(); ok {
+			ids = append(ids, id)
+		}
+	}
+	done <- ids
+}
+
+func TestTopicSendMessagePreservesPerClientOrder(t *testing.T) {
+	topic := NewTopic("orders", 256)
+	client := NewClient("orders", -1, nil, 64)
+	topic.Subscribe(client)
+
+	const count = 50
+	for i := 1; i <= count; i++ {
+		topic.SendMessage(TextMessage(strconv.Itoa(i), "payload"))
+	}
+
+	topic.Unsubscribe(client)
+
+	ids := make(chan []int, 1)
+	drainIds(client, ids)
+	got := <-ids
+
+	if len(got) != count {
+		t.Fatalf("got %d messages, want %d", len(got), count)
+	}
+
+	for i, id := range got {
+		if id != i+1 {
+			t.Fatalf("messages delivered out of order: %v", got)
+		}
+	}
+}
+
+// Reproduces the panic fixed alongside chunk0-5's eviction/fanout path:
+// concurrent SendMessage calls racing a concurrent Unsubscribe used to be
+// able to send on client.messages after it was closed.
+func TestTopicSendMessageDuringUnsubscribeDoesNotPanic(t *testing.T) {
+	const publishers = 50
+
+	for iteration := 0; iteration < 20; iteration++ {
+		topic := NewTopic("racey", 16)
+		client := NewClient("racey", -1, nil, 4)
+		topic.Subscribe(client)
+
+		done := make(chan []int, 1)
+		go drainIds(client, done)
+
+		var wg sync.WaitGroup
+		wg.Add(publishers + 1)
+
+		for i := 0; i < publishers; i++ {
+			go func(i int) {
+				defer wg.Done()
+				topic.SendMessage(TextMessage(strconv.Itoa(i), "payload"))
+			}(i)
+		}
+
+		go func() {
+			defer wg.Done()
+			topic.Unsubscribe(client)
+		}()
+
+		wg.Wait()
+		<-done
+	}
+}
+
+// Covers the three paths Subscribe can take to replay a client's missed
+// history, keyed off how client.lastEventId relates to what the topic's
+// ring buffer still has: a hit serves out of memory synchronously, a miss
+// with no store configured reports the history as expired, and a miss with
+// a store configured falls back to it. All but the first replay
+// asynchronously (see Topic.replayFromStore), so those subtests wait via
+// collectMessages rather than assuming Subscribe has already delivered.
+func TestTopicSubscribeReplaysLastEventId(t *testing.T) {
+	t.Run("within ring buffer", func(t *testing.T) {
+		topic := NewTopic("history", 8)
+		topic.SendMessage(TextMessage("1", "a"))
+		topic.SendMessage(TextMessage("2", "b"))
+		topic.SendMessage(TextMessage("3", "c"))
+
+		client := NewClient(topic.name, 1, nil, 8)
+		topic.Subscribe(client)
+		topic.Unsubscribe(client)
+
+		var got []*Message
+		for message := range client.messages {
+			got = append(got, message)
+		}
+
+		if want := []int{2, 3}; !reflect.DeepEqual(messageIds(got), want) {
+			t.Fatalf("got ids %v, want %v", messageIds(got), want)
+		}
+	})
+
+	t.Run("trimmed from ring buffer, no store configured", func(t *testing.T) {
+		topic := NewTopic("history-trimmed", 1)
+		topic.SendMessage(TextMessage("1", "a"))
+		topic.SendMessage(TextMessage("2", "b"))
+		topic.SendMessage(TextMessage("3", "c"))
+
+		client := NewClient(topic.name, 1, nil, 8)
+		topic.Subscribe(client)
+
+		got := collectMessages(client, 1, time.Second)
+		if len(got) != 1 || got[0].event != "expired" {
+			t.Fatalf("got %v, want a single expired message", got)
+		}
+	})
+
+	t.Run("trimmed from ring buffer, falls back to store", func(t *testing.T) {
+		store := newFakeStore()
+		topic := NewTopic("history-store", 1)
+		topic.store = store
+
+		for i := 0; i < 3; i++ {
+			store.Append(topic.name, TextMessage("", "seed"))
+		}
+		topic.appendHistory(TextMessage("3", "seed"))
+
+		client := NewClient(topic.name, 1, nil, 8)
+		topic.Subscribe(client)
+
+		got := collectMessages(client, 2, time.Second)
+		if want := []int{2, 3}; !reflect.DeepEqual(messageIds(got), want) {
+			t.Fatalf("got ids %v, want %v", messageIds(got), want)
+		}
+	})
+}
+
+// Regression test for the double-delivery fixed alongside chunk0-4's
+// unlocked store replay: a message appended to the store after the replay's
+// upper bound was captured must not also be replayed, since it's expected
+// to arrive via live delivery instead.
+func TestTopicReplayFromStoreRespectsUpperBound(t *testing.T) {
+	store := newFakeStore()
+	topic := NewTopic("replay", 0)
+	topic.store = store
+
+	for i := 0; i < 3; i++ {
+		store.Append(topic.name, TextMessage("", "seed"))
+	}
+	store.Append(topic.name, TextMessage("", "late"))
+
+	client := NewClient(topic.name, 0, nil, 16)
+	topic.clients[client] = true
+
+	topic.replayFromStore(client, 3)
+	close(client.messages)
+
+	var ids []int
+	for message := range client.messages {
+		if id, ok := message.numericId(); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("got %v, want %v", ids, want)
+	}
+}
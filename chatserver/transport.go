@@ -0,0 +1,165 @@
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsPingInterval = 54 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsWriteWait    = 10 * time.Second
+)
+
+// The wire encoding an SSE subscriber receives messages in, selected per
+// request by parseEncoding.
+type encoding int
+
+const (
+	encodingSSE encoding = iota
+	encodingJSON
+	encodingRaw
+)
+
+// Transport is the wire-level connection a Client delivers messages over.
+// sseTransport and wsTransport are the two implementations; Topic.SendMessage
+// and Client.SendMessage don't need to know which one they're talking to.
+type Transport interface {
+	// Writes message to the underlying connection.
+	Write(message *Message) error
+	// Closes the underlying connection.
+	Close() error
+	// Returns the context tied to the underlying connection's lifetime.
+	Context() context.Context
+}
+
+// Streams messages to an http.ResponseWriter, encoded as SSE, ndjson, or raw
+// payload bytes depending on enc.
+type sseTransport struct {
+	response http.ResponseWriter
+	flusher  http.Flusher
+	ctx      context.Context
+	enc      encoding
+}
+
+// Creates a Transport that writes message to response using enc.
+func newSSETransport(response http.ResponseWriter, flusher http.Flusher, ctx context.Context, enc encoding) *sseTransport {
+	return &sseTransport{
+		response,
+		flusher,
+		ctx,
+		enc,
+	}
+}
+
+func (t *sseTransport) Write(message *Message) error {
+	var body string
+
+	switch t.enc {
+	case encodingJSON:
+		body = message.SerializeJSON()
+	case encodingRaw:
+		if len(message.data) == 0 || message.event != "msg" {
+			// raw has no framing for control events like timeout/expired;
+			// dropping them here and letting the caller close the
+			// connection is the cleanest way to end the stream.
+			return nil
+		}
+		body = message.SerializeRaw()
+	default:
+		body = message.SerializeSSE()
+	}
+
+	if _, err := fmt.Fprint(t.response, body); err != nil {
+		return err
+	}
+
+	t.flusher.Flush()
+
+	return nil
+}
+
+func (t *sseTransport) Close() error {
+	return nil
+}
+
+func (t *sseTransport) Context() context.Context {
+	return t.ctx
+}
+
+// Ships messages as JSON frames over a websocket connection, and keeps it
+// alive with a ping/pong heartbeat so idle NAT connections aren't dropped.
+type wsTransport struct {
+	conn   *websocket.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Creates a Transport around conn and starts its keepalive and read loops.
+func newWSTransport(conn *websocket.Conn) *wsTransport {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &wsTransport{
+		conn,
+		ctx,
+		cancel,
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	go t.keepAlive()
+	go t.discardReads()
+
+	return t
+}
+
+func (t *wsTransport) Write(message *Message) error {
+	_ = t.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return t.conn.WriteMessage(websocket.TextMessage, []byte(message.SerializeJSON()))
+}
+
+func (t *wsTransport) Close() error {
+	t.cancel()
+	return t.conn.Close()
+}
+
+func (t *wsTransport) Context() context.Context {
+	return t.ctx
+}
+
+// Sends a ping every wsPingInterval so intermediaries see traffic and the
+// client's pong resets its read deadline. Tears down the transport if a ping
+// can't be written.
+func (t *wsTransport) keepAlive() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				t.cancel()
+				return
+			}
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// This connection is write-only from the server's perspective, but gorilla's
+// Conn still needs reads pumped so pong control frames reach SetPongHandler.
+func (t *wsTransport) discardReads() {
+	for {
+		if _, _, err := t.conn.NextReader(); err != nil {
+			t.cancel()
+			return
+		}
+	}
+}